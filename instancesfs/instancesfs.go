@@ -0,0 +1,371 @@
+// Package instancesfs implements a pathfs.FileSystem that exposes, read-only,
+// the tags and basic metadata of EC2 instances across regions (and, given
+// cross-account credentials, across accounts) as a filesystem tree:
+//
+//	<region>/<instance-id>/tags/<key>
+//	<region>/<instance-id>/metadata/<attribute>
+//
+// Unlike metadatafs, which reads the instance metadata service of the host
+// instance, instancesfs is populated entirely from the EC2 API (DescribeRegions
+// and DescribeInstances), so it works for any instance the credentials can
+// describe, not just the one the filesystem happens to be running on.
+package instancesfs
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/jszwedko/ec2-metadatafs/internal/logging"
+)
+
+const (
+	tagsDir     = "tags"
+	metadataDir = "metadata"
+
+	// defaultRegion is used only to list regions, which can be queried from
+	// any regional EC2 endpoint
+	defaultRegion = "us-east-1"
+)
+
+// ClientFactory returns an EC2 API client for the given region. It exists so
+// that FileSystem can lazily create one client per region instead of every
+// caller needing to manage a session per region up front.
+type ClientFactory func(region string) ec2iface.EC2API
+
+// FileSystem implements pathfs.FileSystem, exposing EC2 instances across
+// regions as a read-only tree of tags and metadata attributes.
+type FileSystem struct {
+	pathfs.FileSystem
+
+	newClient ClientFactory
+	cacheSec  int
+	logger    *logging.Logger
+
+	mu        sync.Mutex
+	regions   []string
+	regionsAt time.Time
+
+	instances   map[string][]*ec2.Instance // region -> instances
+	instancesAt map[string]time.Time
+}
+
+// New returns a FileSystem that describes instances using clients built by
+// newClient, caching DescribeRegions/DescribeInstances results for cacheSec
+// seconds (0 disables caching, -1 caches indefinitely).
+func New(newClient ClientFactory, cacheSec int, logger *logging.Logger) *FileSystem {
+	return &FileSystem{
+		FileSystem:  pathfs.NewDefaultFileSystem(),
+		newClient:   newClient,
+		cacheSec:    cacheSec,
+		logger:      logger,
+		instances:   map[string][]*ec2.Instance{},
+		instancesAt: map[string]time.Time{},
+	}
+}
+
+func (fs *FileSystem) stale(at time.Time) bool {
+	if at.IsZero() {
+		return true
+	}
+	if fs.cacheSec < 0 {
+		return false
+	}
+	if fs.cacheSec == 0 {
+		return true
+	}
+	return time.Since(at) > time.Duration(fs.cacheSec)*time.Second
+}
+
+// listRegions returns the enabled regions for the account, per DescribeRegions
+func (fs *FileSystem) listRegions() ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !fs.stale(fs.regionsAt) {
+		return fs.regions, nil
+	}
+
+	out, err := fs.newClient(defaultRegion).DescribeRegions(&ec2.DescribeRegionsInput{})
+	if err != nil {
+		return nil, err
+	}
+
+	regions := make([]string, 0, len(out.Regions))
+	for _, r := range out.Regions {
+		regions = append(regions, aws.StringValue(r.RegionName))
+	}
+
+	fs.regions = regions
+	fs.regionsAt = time.Now()
+	return regions, nil
+}
+
+// listInstances returns all instances in region, paging through
+// DescribeInstances as needed
+func (fs *FileSystem) listInstances(region string) ([]*ec2.Instance, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !fs.stale(fs.instancesAt[region]) {
+		return fs.instances[region], nil
+	}
+
+	var instances []*ec2.Instance
+	err := fs.newClient(region).DescribeInstancesPages(&ec2.DescribeInstancesInput{},
+		func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+			for _, res := range page.Reservations {
+				instances = append(instances, res.Instances...)
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	fs.instances[region] = instances
+	fs.instancesAt[region] = time.Now()
+	return instances, nil
+}
+
+func (fs *FileSystem) instance(region, instanceID string) (*ec2.Instance, error) {
+	instances, err := fs.listInstances(region)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range instances {
+		if aws.StringValue(i.InstanceId) == instanceID {
+			return i, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// metadataAttrs derives the flat set of metadata(-like) attributes exposed
+// for an instance from its DescribeInstances representation
+func metadataAttrs(i *ec2.Instance) map[string]string {
+	attrs := map[string]string{
+		"instance-id":        aws.StringValue(i.InstanceId),
+		"instance-type":      aws.StringValue(i.InstanceType),
+		"image-id":           aws.StringValue(i.ImageId),
+		"private-ip-address": aws.StringValue(i.PrivateIpAddress),
+		"public-ip-address":  aws.StringValue(i.PublicIpAddress),
+		"key-name":           aws.StringValue(i.KeyName),
+	}
+
+	if i.State != nil {
+		attrs["instance-state"] = aws.StringValue(i.State.Name)
+	}
+	if i.Placement != nil {
+		attrs["availability-zone"] = aws.StringValue(i.Placement.AvailabilityZone)
+	}
+	if i.VpcId != nil {
+		attrs["vpc-id"] = aws.StringValue(i.VpcId)
+	}
+	if i.SubnetId != nil {
+		attrs["subnet-id"] = aws.StringValue(i.SubnetId)
+	}
+
+	for k := range attrs {
+		if attrs[k] == "" {
+			delete(attrs, k)
+		}
+	}
+
+	return attrs
+}
+
+func tagsOf(i *ec2.Instance) map[string]string {
+	tags := make(map[string]string, len(i.Tags))
+	for _, t := range i.Tags {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return tags
+}
+
+// split parses name into its up-to-4 path components:
+// region, instanceID, kind ("tags" or "metadata"), and key
+func split(name string) (region, instanceID, kind, key string) {
+	parts := strings.SplitN(name, "/", 4)
+	switch len(parts) {
+	case 4:
+		key = parts[3]
+		fallthrough
+	case 3:
+		kind = parts[2]
+		fallthrough
+	case 2:
+		instanceID = parts[1]
+		fallthrough
+	case 1:
+		region = parts[0]
+	}
+	return region, instanceID, kind, key
+}
+
+// GetAttr implements pathfs.FileSystem
+func (fs *FileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	now := uint64(time.Now().Unix())
+	dirAttr := &fuse.Attr{Mode: fuse.S_IFDIR | 0555, Mtime: now}
+
+	if name == "" {
+		return dirAttr, fuse.OK
+	}
+
+	region, instanceID, kind, key := split(name)
+
+	if instanceID == "" {
+		regions, err := fs.listRegions()
+		if err != nil {
+			fs.logger.Warningf("failed to list regions: %s", err)
+			return nil, fuse.EIO
+		}
+		for _, r := range regions {
+			if r == region {
+				return dirAttr, fuse.OK
+			}
+		}
+		return nil, fuse.ENOENT
+	}
+
+	inst, err := fs.instance(region, instanceID)
+	if err != nil {
+		fs.logger.Warningf("failed to describe instances in %s: %s", region, err)
+		return nil, fuse.EIO
+	}
+	if inst == nil {
+		return nil, fuse.ENOENT
+	}
+
+	if kind == "" {
+		return dirAttr, fuse.OK
+	}
+	if kind != tagsDir && kind != metadataDir {
+		return nil, fuse.ENOENT
+	}
+	if key == "" {
+		return dirAttr, fuse.OK
+	}
+
+	var value string
+	var ok bool
+	if kind == tagsDir {
+		value, ok = tagsOf(inst)[key]
+	} else {
+		value, ok = metadataAttrs(inst)[key]
+	}
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+
+	return &fuse.Attr{Mode: fuse.S_IFREG | 0444, Size: uint64(len(value)), Mtime: now}, fuse.OK
+}
+
+// OpenDir implements pathfs.FileSystem
+func (fs *FileSystem) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	region, instanceID, kind, _ := split(name)
+
+	if region == "" {
+		regions, err := fs.listRegions()
+		if err != nil {
+			fs.logger.Warningf("failed to list regions: %s", err)
+			return nil, fuse.EIO
+		}
+		entries := make([]fuse.DirEntry, len(regions))
+		for i, r := range regions {
+			entries[i] = fuse.DirEntry{Name: r, Mode: fuse.S_IFDIR}
+		}
+		return entries, fuse.OK
+	}
+
+	if instanceID == "" {
+		instances, err := fs.listInstances(region)
+		if err != nil {
+			fs.logger.Warningf("failed to describe instances in %s: %s", region, err)
+			return nil, fuse.EIO
+		}
+		entries := make([]fuse.DirEntry, len(instances))
+		for i, inst := range instances {
+			entries[i] = fuse.DirEntry{Name: aws.StringValue(inst.InstanceId), Mode: fuse.S_IFDIR}
+		}
+		return entries, fuse.OK
+	}
+
+	inst, err := fs.instance(region, instanceID)
+	if err != nil {
+		fs.logger.Warningf("failed to describe instances in %s: %s", region, err)
+		return nil, fuse.EIO
+	}
+	if inst == nil {
+		return nil, fuse.ENOENT
+	}
+
+	if kind == "" {
+		return []fuse.DirEntry{
+			{Name: tagsDir, Mode: fuse.S_IFDIR},
+			{Name: metadataDir, Mode: fuse.S_IFDIR},
+		}, fuse.OK
+	}
+
+	var values map[string]string
+	switch kind {
+	case tagsDir:
+		values = tagsOf(inst)
+	case metadataDir:
+		values = metadataAttrs(inst)
+	default:
+		return nil, fuse.ENOENT
+	}
+
+	entries := make([]fuse.DirEntry, 0, len(values))
+	for k := range values {
+		entries = append(entries, fuse.DirEntry{Name: k, Mode: fuse.S_IFREG})
+	}
+	return entries, fuse.OK
+}
+
+// Open implements pathfs.FileSystem. The tree is read-only: writes are
+// refused with EROFS.
+func (fs *FileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EROFS
+	}
+
+	region, instanceID, kind, key := split(name)
+	if instanceID == "" || key == "" {
+		return nil, fuse.ENOENT
+	}
+
+	inst, err := fs.instance(region, instanceID)
+	if err != nil {
+		fs.logger.Warningf("failed to describe instances in %s: %s", region, err)
+		return nil, fuse.EIO
+	}
+	if inst == nil {
+		return nil, fuse.ENOENT
+	}
+
+	var value string
+	var ok bool
+	switch kind {
+	case tagsDir:
+		value, ok = tagsOf(inst)[key]
+	case metadataDir:
+		value, ok = metadataAttrs(inst)[key]
+	default:
+		return nil, fuse.ENOENT
+	}
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+
+	return nodefs.NewDataFile([]byte(value)), fuse.OK
+}
@@ -0,0 +1,94 @@
+package instancesfs
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name           string
+		wantRegion     string
+		wantInstanceID string
+		wantKind       string
+		wantKey        string
+	}{
+		{name: "", wantRegion: ""},
+		{name: "us-east-1", wantRegion: "us-east-1"},
+		{name: "us-east-1/i-0123456789abcdef0", wantRegion: "us-east-1", wantInstanceID: "i-0123456789abcdef0"},
+		{
+			name:           "us-east-1/i-0123456789abcdef0/tags",
+			wantRegion:     "us-east-1",
+			wantInstanceID: "i-0123456789abcdef0",
+			wantKind:       "tags",
+		},
+		{
+			name:           "us-east-1/i-0123456789abcdef0/tags/Name",
+			wantRegion:     "us-east-1",
+			wantInstanceID: "i-0123456789abcdef0",
+			wantKind:       "tags",
+			wantKey:        "Name",
+		},
+		{
+			name:           "us-east-1/i-0123456789abcdef0/metadata/instance-type",
+			wantRegion:     "us-east-1",
+			wantInstanceID: "i-0123456789abcdef0",
+			wantKind:       "metadata",
+			wantKey:        "instance-type",
+		},
+		{
+			// A tag key containing a slash shouldn't be split further; it
+			// all belongs to key, since SplitN is capped at 4 parts.
+			name:           "us-east-1/i-0123456789abcdef0/tags/team/name",
+			wantRegion:     "us-east-1",
+			wantInstanceID: "i-0123456789abcdef0",
+			wantKind:       "tags",
+			wantKey:        "team/name",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			region, instanceID, kind, key := split(tt.name)
+			if region != tt.wantRegion || instanceID != tt.wantInstanceID || kind != tt.wantKind || key != tt.wantKey {
+				t.Errorf("split(%q) = (%q, %q, %q, %q), want (%q, %q, %q, %q)",
+					tt.name, region, instanceID, kind, key,
+					tt.wantRegion, tt.wantInstanceID, tt.wantKind, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestMetadataAttrs(t *testing.T) {
+	inst := &ec2.Instance{
+		InstanceId:       aws.String("i-0123456789abcdef0"),
+		InstanceType:     aws.String("t3.micro"),
+		ImageId:          aws.String("ami-0123456789abcdef0"),
+		PrivateIpAddress: aws.String("10.0.0.1"),
+		PublicIpAddress:  nil,
+		KeyName:          aws.String("my-key"),
+		State:            &ec2.InstanceState{Name: aws.String("running")},
+		Placement:        &ec2.Placement{AvailabilityZone: aws.String("us-east-1a")},
+		VpcId:            aws.String("vpc-0123456789abcdef0"),
+		SubnetId:         nil,
+	}
+
+	want := map[string]string{
+		"instance-id":        "i-0123456789abcdef0",
+		"instance-type":      "t3.micro",
+		"image-id":           "ami-0123456789abcdef0",
+		"private-ip-address": "10.0.0.1",
+		"key-name":           "my-key",
+		"instance-state":     "running",
+		"availability-zone":  "us-east-1a",
+		"vpc-id":             "vpc-0123456789abcdef0",
+	}
+
+	got := metadataAttrs(inst)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("metadataAttrs() = %#v, want %#v", got, want)
+	}
+}
@@ -0,0 +1,132 @@
+// Package logging provides a small leveled logger used throughout
+// ec2-metadatafs. It wraps the standard library logger and, when enabled,
+// mirrors messages to syslog.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"os"
+)
+
+// Level identifies the severity of a log message
+type Level int
+
+// Log levels, ordered from least to most severe
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarningLevel
+	ErrorLevel
+)
+
+// Logger is a small leveled wrapper around the stdlib logger that optionally
+// mirrors output to syslog. MinLevel controls which messages are written;
+// messages below MinLevel are discarded.
+type Logger struct {
+	MinLevel Level
+
+	logger *log.Logger
+	syslog *syslog.Writer
+}
+
+// NewLogger returns a Logger that writes to stderr at InfoLevel by default
+func NewLogger() *Logger {
+	return &Logger{
+		MinLevel: InfoLevel,
+		logger:   log.New(os.Stderr, "", log.LstdFlags),
+	}
+}
+
+// EnableSyslog additionally mirrors log output to syslog at the given
+// facility
+func (l *Logger) EnableSyslog(facility syslog.Priority) error {
+	w, err := syslog.New(facility|syslog.LOG_INFO, "ec2-metadatafs")
+	if err != nil {
+		return fmt.Errorf("unable to connect to syslog: %s", err)
+	}
+
+	l.syslog = w
+	return nil
+}
+
+// Close releases any resources (e.g. the syslog connection) held by the
+// logger
+func (l *Logger) Close() error {
+	if l.syslog != nil {
+		return l.syslog.Close()
+	}
+	return nil
+}
+
+func (l *Logger) log(level Level, format string, args ...interface{}) {
+	if level < l.MinLevel {
+		return
+	}
+
+	msg := fmt.Sprintf(format, args...)
+	l.logger.Print(msg)
+
+	if l.syslog == nil {
+		return
+	}
+
+	switch level {
+	case DebugLevel:
+		l.syslog.Debug(msg)
+	case InfoLevel:
+		l.syslog.Info(msg)
+	case WarningLevel:
+		l.syslog.Warning(msg)
+	case ErrorLevel:
+		l.syslog.Err(msg)
+	}
+}
+
+// Debugf logs a message at DebugLevel
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(DebugLevel, format, args...)
+}
+
+// Infof logs a message at InfoLevel
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(InfoLevel, format, args...)
+}
+
+// Warningf logs a message at WarningLevel
+func (l *Logger) Warningf(format string, args ...interface{}) {
+	l.log(WarningLevel, format, args...)
+}
+
+// Fatalf logs a message at ErrorLevel and then exits the process, matching
+// the behavior of log.Fatalf
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.log(ErrorLevel, format, args...)
+	os.Exit(1)
+}
+
+// levelWriter adapts a Level into an io.WriteCloser so that it can be handed
+// to packages (e.g. the stdlib log package, go-fuse) that only know how to
+// write lines of text
+type levelWriter struct {
+	logger *Logger
+	level  Level
+}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	w.logger.log(w.level, "%s", string(p))
+	return len(p), nil
+}
+
+func (w *levelWriter) Close() error {
+	return nil
+}
+
+// Writer returns an io.WriteCloser that writes lines to the logger at the
+// given level. This is used to redirect other packages' loggers (e.g. the
+// stdlib "log" package used by go-fuse) through this logger.
+func (l *Logger) Writer(level Level) io.WriteCloser {
+	return &levelWriter{logger: l, level: level}
+}
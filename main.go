@@ -2,9 +2,11 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"log/syslog"
 	"os"
+	"os/exec"
 	"os/signal"
 	"sort"
 	"strconv"
@@ -15,14 +17,20 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 	"github.com/hanwen/go-fuse/unionfs"
 	"github.com/jessevdk/go-flags"
+	"github.com/jszwedko/ec2-metadatafs/instancesfs"
 	"github.com/jszwedko/ec2-metadatafs/internal/logging"
 	"github.com/jszwedko/ec2-metadatafs/metadatafs"
 	"github.com/jszwedko/ec2-metadatafs/tagsfs"
@@ -90,13 +98,17 @@ func (f FacilityNamesSlice) Swap(i, j int) {
 // Options holds the command line arguments and flags
 // Intended for use with go-flags
 type Options struct {
-	Verbose      []bool       `short:"v" long:"verbose"     description:"Print verbose logs, can be specified multiple times (up to 2)"`
-	Foreground   bool         `short:"f" long:"foreground"  description:"Run in foreground"`
-	Version      bool         `short:"V" long:"version"     description:"Display version info"`
-	Endpoint     string       `short:"e" long:"endpoint"    description:"EC2 metadata service HTTP endpoint" default:"http://169.254.169.254/latest/"`
-	CacheSec     int          `short:"c" long:"cachesec"    description:"Number of seconds to cache files attributes and directory listings. 0 to disable, -1 for indefinite." default:"0"`
-	Tags         bool         `short:"t" long:"tags"        description:"Mount EC2 instance tags at <mount point>/tags"`
-	MountOptions mountOptions `short:"o" long:"options"     description:"Mount options, see below for description"`
+	Verbose        []bool       `short:"v" long:"verbose"     description:"Print verbose logs, can be specified multiple times (up to 2)"`
+	Foreground     bool         `short:"f" long:"foreground"  description:"Run in foreground"`
+	Version        bool         `short:"V" long:"version"     description:"Display version info"`
+	Endpoint       string       `short:"e" long:"endpoint"    description:"EC2 metadata service HTTP endpoint" default:"http://169.254.169.254/latest/"`
+	IMDSVersion    string       `long:"imds-version"          description:"IMDS version to use: v1, v2, or auto (try v2, fall back to v1)" default:"auto"`
+	CacheSec       int          `short:"c" long:"cachesec"    description:"Number of seconds to cache files attributes and directory listings. 0 to disable, -1 for indefinite." default:"0"`
+	Tags           bool         `short:"t" long:"tags"        description:"Mount EC2 instance tags at <mount point>/tags"`
+	ReadOnlyTags   bool         `long:"read-only-tags"        description:"Mount the tags filesystem read-only instead of allowing tag creation/modification/deletion"`
+	Browse         bool         `long:"browse"                description:"Mount a read-only, multi-region browser of EC2 instance tags and metadata at <mount point>/instances"`
+	AggregateViews bool         `long:"aggregate-views"       description:"Expose metadata.json, metadata.yaml, tags.json, and tags.yaml aggregate views at the mount root"`
+	MountOptions   mountOptions `short:"o" long:"options"     description:"Mount options, see below for description"`
 
 	DisableSyslog  bool   `short:"n" long:"no-syslog"        description:"Disable syslog when daemonized"`
 	SyslogFacility string `short:"F" long:"syslog-facility"  description:"Syslog facility to use when daemonized (see below for options)" default:"USER"`
@@ -112,20 +124,140 @@ type awsCredentials struct {
 	AWSAccessKeyID     string `long:"aws-access-key-id"     description:"AWS Access Key ID (adds to credential chain, see below)"`
 	AWSSecretAccessKey string `long:"aws-secret-access-key" description:"AWS Secret Access key (adds to credential chain, see below)"`
 	AWSSessionToken    string `long:"aws-session-token"     description:"AWS session token (adds to credential chain, see below)"`
+
+	AssumeRoleARN         string `long:"assume-role-arn"           description:"ARN of an IAM role to assume after resolving the base credential chain (adds to credential chain, see below)"`
+	AssumeRoleExternalID  string `long:"assume-role-external-id"   description:"External ID to pass when assuming --assume-role-arn"`
+	AssumeRoleSessionName string `long:"assume-role-session-name"  description:"Session name to use when assuming --assume-role-arn" default:"ec2-metadatafs"`
+	MFASerial             string `long:"mfa-serial"                description:"Serial number (or ARN) of the MFA device to use when assuming --assume-role-arn"`
+	MFATokenCommand       string `long:"mfa-token-command"         description:"Command to run to retrieve the MFA token code; prompted on the controlling TTY if not set"`
+
+	WebIdentityTokenFile string `long:"web-identity-token-file" description:"Path to a web identity (IRSA) token file to assume --assume-role-arn with; falls back to $AWS_WEB_IDENTITY_TOKEN_FILE (adds to credential chain, see below)"`
+}
+
+// containerCredentialsProvider returns the provider for the ECS/EKS
+// container credentials endpoint (the same mechanism used by the Docker
+// awslogs driver and the ECS/EKS agents), or nil if none of the
+// AWS_CONTAINER_CREDENTIALS_* environment variables are set.
+func containerCredentialsProvider() credentials.Provider {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if endpoint == "" {
+		if relURI := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relURI != "" {
+			endpoint = ecsContainerCredentialsEndpoint + relURI
+		}
+	}
+	if endpoint == "" {
+		return nil
+	}
+
+	authToken := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if authToken == "" {
+		if tokenFile := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); tokenFile != "" {
+			data, err := ioutil.ReadFile(tokenFile)
+			if err != nil {
+				authToken = ""
+			} else {
+				authToken = strings.TrimSpace(string(data))
+			}
+		}
+	}
+
+	return endpointcreds.NewProviderClient(*aws.NewConfig(), defaults.Handlers(), endpoint,
+		func(p *endpointcreds.Provider) {
+			if authToken != "" {
+				p.AuthorizationToken = authToken
+			}
+		})
 }
 
-func (a *awsCredentials) credentialChain() *credentials.Credentials {
-	return credentials.NewChainCredentials([]credentials.Provider{
+// ecsContainerCredentialsEndpoint is the well-known link-local address that
+// AWS_CONTAINER_CREDENTIALS_RELATIVE_URI is resolved against
+const ecsContainerCredentialsEndpoint = "http://169.254.170.2"
+
+// webIdentityTokenFile returns the token file to use for IRSA-style web
+// identity role assumption, preferring the explicit flag over the
+// environment variable the SDK/EKS convention uses
+func (a *awsCredentials) webIdentityTokenFile() string {
+	if a.WebIdentityTokenFile != "" {
+		return a.WebIdentityTokenFile
+	}
+	return os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+}
+
+// webIdentityRoleARN returns the role ARN to assume with the web identity
+// token, preferring --assume-role-arn but falling back to $AWS_ROLE_ARN --
+// the other half of the pair EKS injects automatically for IRSA, alongside
+// AWS_WEB_IDENTITY_TOKEN_FILE.
+func (a *awsCredentials) webIdentityRoleARN() string {
+	if a.AssumeRoleARN != "" {
+		return a.AssumeRoleARN
+	}
+	return os.Getenv("AWS_ROLE_ARN")
+}
+
+func (a *awsCredentials) credentialChain(region string) *credentials.Credentials {
+	providers := []credentials.Provider{
 		&credentials.StaticProvider{Value: credentials.Value{
 			AccessKeyID:     a.AWSAccessKeyID,
 			SecretAccessKey: a.AWSAccessKeyID,
 			SessionToken:    a.AWSSessionToken}},
 		&credentials.EnvProvider{},
 		&credentials.SharedCredentialsProvider{},
-		&ec2rolecreds.EC2RoleProvider{Client: ec2metadata.New(session.New())},
+	}
+
+	if p := containerCredentialsProvider(); p != nil {
+		providers = append(providers, p)
+	}
+
+	if tokenFile := a.webIdentityTokenFile(); tokenFile != "" {
+		sess := session.New(&aws.Config{Region: aws.String(region)})
+		providers = append(providers, stscreds.NewWebIdentityRoleProvider(sts.New(sess), a.webIdentityRoleARN(), a.AssumeRoleSessionName, tokenFile))
+	}
+
+	providers = append(providers, &ec2rolecreds.EC2RoleProvider{Client: ec2metadata.New(session.New())})
+
+	base := credentials.NewChainCredentials(providers)
+
+	if a.AssumeRoleARN == "" || a.webIdentityTokenFile() != "" {
+		// Web identity role assumption is handled by the
+		// WebIdentityRoleProvider above; --assume-role-arn only needs to
+		// additionally wrap the chain in stscreds when it isn't already
+		// being used to satisfy a web identity token.
+		return base
+	}
+
+	sess := session.New(&aws.Config{Region: aws.String(region), Credentials: base})
+	return stscreds.NewCredentials(sess, a.AssumeRoleARN, func(p *stscreds.AssumeRoleProvider) {
+		if a.AssumeRoleExternalID != "" {
+			p.ExternalID = aws.String(a.AssumeRoleExternalID)
+		}
+		if a.AssumeRoleSessionName != "" {
+			p.RoleSessionName = a.AssumeRoleSessionName
+		}
+		if a.MFASerial != "" {
+			p.SerialNumber = aws.String(a.MFASerial)
+			p.TokenProvider = a.mfaTokenProvider()
+		}
 	})
 }
 
+// mfaTokenProvider returns a stscreds.StdinTokenProvider-like func that
+// retrieves an MFA token code, either from MFATokenCommand if set, or
+// otherwise by prompting on the controlling TTY
+func (a *awsCredentials) mfaTokenProvider() func() (string, error) {
+	if a.MFATokenCommand == "" {
+		return stscreds.StdinTokenProvider
+	}
+
+	return func() (string, error) {
+		fields := strings.Fields(a.MFATokenCommand)
+		out, err := exec.Command(fields[0], fields[1:]...).Output()
+		if err != nil {
+			return "", fmt.Errorf("mfa-token-command failed: %s", err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+}
+
 // mountOptions implements flags.Marshaller and flags.Unmarshaller interface to
 // read `mount` style options from the user
 type mountOptions struct {
@@ -182,8 +314,8 @@ func (o *mountOptions) ExtractOption(s string) (ok bool, value string) {
 
 // mountTags mounts another endpoint onto the FUSE FS at tags/ exposing the EC2
 // instance tags as files
-func mountTags(nfs *pathfs.PathNodeFs, options *Options, logger *logging.Logger) {
-	svc := ec2metadata.New(session.New())
+func mountTags(nfs *pathfs.PathNodeFs, options *Options, logger *logging.Logger, mdfs *metadatafs.FileSystem) {
+	svc := ec2metadata.New(session.New(&aws.Config{HTTPClient: mdfs.HTTPClient()}))
 	instanceID, err := svc.GetMetadata("instance-id")
 	if err != nil {
 		logger.Fatalf("failed to query instance id to initialize tags mount: %v\n", err)
@@ -195,22 +327,89 @@ func mountTags(nfs *pathfs.PathNodeFs, options *Options, logger *logging.Logger)
 
 	sess := session.New(&aws.Config{
 		Region:      aws.String(region),
-		Credentials: options.AWSCredentials.credentialChain(),
+		Credentials: options.AWSCredentials.credentialChain(region),
 	})
 
-	status := nfs.Mount(
-		"tags",
-		pathfs.NewPathNodeFs(tagsfs.New(ec2.New(sess), instanceID, logger), nil).Root(), nil)
+	tfs := tagsfs.New(ec2.New(sess), instanceID, logger, options.CacheSec, options.ReadOnlyTags)
+	status := nfs.Mount("tags", pathfs.NewPathNodeFs(tfs, nil).Root(), nil)
 	if status != fuse.OK {
 		logger.Fatalf("tags mount fail: %v\n", status)
 	}
+
+	if options.AggregateViews {
+		mdfs.SetTagsSource(tfs.LoadedTags)
+	}
+}
+
+// mountInstances mounts a read-only, multi-region browser of EC2 instance
+// tags and metadata at instances/. Unlike mountTags, this talks only to the
+// EC2 API (not the host's IMDS), so its goroutine doesn't depend on the host
+// being a reachable EC2 instance the way mountTags's does.
+func mountInstances(nfs *pathfs.PathNodeFs, options *Options, logger *logging.Logger) {
+	newClient := func(region string) ec2iface.EC2API {
+		return ec2.New(session.New(&aws.Config{
+			Region:      aws.String(region),
+			Credentials: options.AWSCredentials.credentialChain(region),
+		}))
+	}
+
+	status := nfs.Mount(
+		"instances",
+		pathfs.NewPathNodeFs(instancesfs.New(newClient, options.CacheSec, logger), nil).Root(), nil)
+	if status != fuse.OK {
+		logger.Fatalf("instances mount fail: %v\n", status)
+	}
+}
+
+// emptyRootFS is a root filesystem that serves only an empty root directory,
+// for use when nothing is mounted at the root itself (e.g. --browse-only
+// mode) and sub-mounts like instances/ are bolted on separately. Unlike
+// pathfs.NewDefaultFileSystem(), which returns ENOSYS even for GetAttr(""),
+// this answers just enough to let FUSE mount successfully.
+type emptyRootFS struct {
+	pathfs.FileSystem
+}
+
+func newEmptyRootFS() pathfs.FileSystem {
+	return &emptyRootFS{FileSystem: pathfs.NewDefaultFileSystem()}
+}
+
+func (fs *emptyRootFS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if name == "" {
+		return &fuse.Attr{Mode: fuse.S_IFDIR | 0555}, fuse.OK
+	}
+	return nil, fuse.ENOENT
+}
+
+func (fs *emptyRootFS) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if name == "" {
+		return nil, fuse.OK
+	}
+	return nil, fuse.ENOENT
 }
 
 func prepareServer(options *Options, logger *logging.Logger) *fuse.Server {
+	// fs is the filesystem mounted at the root, with tags/ and instances/
+	// mounted as sub-trees onto it below -- the same FUSE sub-mount
+	// mechanism already used for tags/, which in effect unions whichever of
+	// the root, tags/, and instances/ trees are enabled. Normally the root
+	// is metadatafs (the host's own IMDS tree), but a --browse-only
+	// invocation (no --tags) has no need to talk to the host's IMDS at all,
+	// so the root is left as an empty directory instead -- otherwise every
+	// root listing would block on a GET to a likely-unreachable IMDS
+	// endpoint before anything under instances/ became usable.
+	// mdfs is kept separately (rather than just as fs) so that mountTags can
+	// reuse its IMDSv2 token cache.
 	var fs pathfs.FileSystem
 
 	logger.Debugf("mounting at %s directed at %s with options: %+v", options.Args.Mountpoint, options.Endpoint, options.MountOptions.opts)
-	fs = metadatafs.New(options.Endpoint, logger)
+	mdfs := metadatafs.New(options.Endpoint, options.IMDSVersion, options.AggregateViews, logger)
+	if options.Browse && !options.Tags {
+		logger.Debugf("browse-only mode: root is not backed by the host IMDS")
+		fs = newEmptyRootFS()
+	} else {
+		fs = mdfs
+	}
 	switch {
 	case options.CacheSec == 0:
 		logger.Debugf("caching disabled")
@@ -237,11 +436,20 @@ func prepareServer(options *Options, logger *logging.Logger) *fuse.Server {
 		go func() {
 			server.WaitMount()
 			logger.Debugf("mounting tags")
-			mountTags(nfs, options, logger)
+			mountTags(nfs, options, logger, mdfs)
 			logger.Debugf("tags mounted")
 		}()
 	}
 
+	if options.Browse {
+		go func() {
+			server.WaitMount()
+			logger.Debugf("mounting instances browser")
+			mountInstances(nfs, options, logger)
+			logger.Debugf("instances browser mounted")
+		}()
+	}
+
 	// Unmount when the process exits
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
@@ -324,10 +532,20 @@ Mount options:
   -o debug                     Enable debug logging, same as -v
   -o fuse_debug                Enable fuse_debug logging (implies debug), same as -vv
   -o endpoint=ENDPOINT         EC2 metadata service HTTP endpoint, same as --endpoint=
+  -o imds_version=v1|v2|auto   IMDS version to use, same as --imds-version= (default auto)
   -o tags                      Mount the instance tags at <mount point>/tags, same as --tags
+  -o ro_tags                   Mount the tags filesystem read-only, same as --read-only-tags
+  -o browse                    Mount the instances browser at <mount point>/instances, same as --browse
+  -o aggregate                 Expose metadata.json/.yaml and tags.json/.yaml, same as --aggregate-views
   -o aws_access_key_id=ID      AWS API access key (see below), same as --aws-access-key-id=
   -o aws_secret_access_key=KEY AWS API secret key (see below), same as --aws-secret-access-key=
   -o aws_session_token=KEY     AWS API session token (see below), same as --aws-session-token=
+  -o assume_role_arn=ARN       IAM role to assume (see below), same as --assume-role-arn=
+  -o assume_role_external_id=  External ID for role assumption, same as --assume-role-external-id=
+  -o assume_role_session_name= Session name for role assumption, same as --assume-role-session-name=
+  -o mfa_serial=SERIAL         MFA device serial/ARN for role assumption, same as --mfa-serial=
+  -o mfa_token_command=CMD     Command to retrieve the MFA token code, same as --mfa-token-command=
+  -o web_identity_token_file=  Web identity (IRSA) token file, same as --web-identity-token-file=
   -o cachesec=SEC              Number of seconds to cache files attributes and directory listings, same as --cachesec
   -o syslog_facility=					 Syslog facility to send messages upon when daemonized (see below)
   -o no_syslog                 Disable logging to syslog when daemonized
@@ -341,10 +559,47 @@ AWS credential chain:
   - Provided AWS credentials via flags or mount options
   - $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY, and $AWS_SESSION_TOKEN environment variables
   - Shared credentials file -- respects $AWS_DEFAULT_PROFILE and $AWS_SHARED_CREDENTIALS_FILE
+  - The ECS/EKS container credentials endpoint, per $AWS_CONTAINER_CREDENTIALS_RELATIVE_URI,
+    $AWS_CONTAINER_CREDENTIALS_FULL_URI, and $AWS_CONTAINER_AUTHORIZATION_TOKEN[_FILE]
+  - A web identity (IRSA) token file, via --web-identity-token-file or $AWS_WEB_IDENTITY_TOKEN_FILE
   - IAM role associated with the instance
 
   Note that the AWS session token is only needed for temporary credentials from AWS security token service.
 
+  --web-identity-token-file (or $AWS_WEB_IDENTITY_TOKEN_FILE, as set by EKS when
+  IRSA is enabled for a pod's service account) assumes a role using the web
+  identity token instead of STS AssumeRole, letting IRSA work without any
+  shared config files. The role ARN comes from --assume-role-arn, falling
+  back to $AWS_ROLE_ARN (also injected automatically by EKS) if that isn't
+  set.
+
+  If --assume-role-arn is set, the role is assumed (via STS AssumeRole) on top
+  of whichever of the above resolves, and the resulting temporary credentials
+  are used instead, refreshing automatically before they expire. Use
+  --assume-role-external-id and --assume-role-session-name to control the
+  AssumeRole call, and --mfa-serial if the role requires MFA -- the token code
+  is read from the controlling TTY, or from --mfa-token-command if set.
+
+  The tags mount (--tags or -o tags) is writable by default: writing a file
+  calls CreateTags, removing one calls DeleteTags, and creating one adds an
+  empty tag. This requires the ec2:CreateTags and ec2:DeleteTags permissions
+  in addition to ec2:DescribeTags; pass --read-only-tags (or -o ro_tags) to
+  disable writes and only require ec2:DescribeTags.
+
+  The instances browser (--browse or -o browse) exposes, read-only, the tags
+  and basic metadata of every EC2 instance visible to the credentials across
+  all regions at <mount point>/instances/<region>/<instance-id>/{tags,metadata}.
+  It requires ec2:DescribeRegions and ec2:DescribeInstances, and is populated
+  via the EC2 API rather than IMDS, so it does not require the host itself to
+  be an EC2 instance. Using --browse without --tags mounts an empty
+  directory at the root instead of the host's own metadata, so that the
+  mount doesn't depend on the host's IMDS being reachable either.
+
+  --aggregate-views (or -o aggregate) additionally exposes metadata.json and
+  metadata.yaml (the full metadata tree) and, when --tags is also set,
+  tags.json and tags.yaml (the full tag map) at the mount root. Each is
+  regenerated from the live tree on every read.
+
 Caching:
 
 Caching of the following is supported and controlled via the cachesec parameter:
@@ -385,6 +640,10 @@ Report bugs to:
 		options.Endpoint = value
 	}
 
+	if ok, value := options.MountOptions.ExtractOption("imds_version"); ok {
+		options.IMDSVersion = value
+	}
+
 	if ok, value := options.MountOptions.ExtractOption("aws_access_key_id"); ok {
 		options.AWSCredentials.AWSAccessKeyID = value
 	}
@@ -397,6 +656,30 @@ Report bugs to:
 		options.AWSCredentials.AWSSessionToken = value
 	}
 
+	if ok, value := options.MountOptions.ExtractOption("assume_role_arn"); ok {
+		options.AWSCredentials.AssumeRoleARN = value
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("assume_role_external_id"); ok {
+		options.AWSCredentials.AssumeRoleExternalID = value
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("assume_role_session_name"); ok {
+		options.AWSCredentials.AssumeRoleSessionName = value
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("mfa_serial"); ok {
+		options.AWSCredentials.MFASerial = value
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("mfa_token_command"); ok {
+		options.AWSCredentials.MFATokenCommand = value
+	}
+
+	if ok, value := options.MountOptions.ExtractOption("web_identity_token_file"); ok {
+		options.AWSCredentials.WebIdentityTokenFile = value
+	}
+
 	if ok, value := options.MountOptions.ExtractOption("cachesec"); ok {
 		options.CacheSec, err = strconv.Atoi(value)
 		if err != nil {
@@ -409,6 +692,18 @@ Report bugs to:
 		options.Tags = true
 	}
 
+	if ok, _ := options.MountOptions.ExtractOption("ro_tags"); ok {
+		options.ReadOnlyTags = true
+	}
+
+	if ok, _ := options.MountOptions.ExtractOption("browse"); ok {
+		options.Browse = true
+	}
+
+	if ok, _ := options.MountOptions.ExtractOption("aggregate"); ok {
+		options.AggregateViews = true
+	}
+
 	if ok, _ := options.MountOptions.ExtractOption("no_syslog"); ok {
 		options.DisableSyslog = true
 	}
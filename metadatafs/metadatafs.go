@@ -0,0 +1,610 @@
+// Package metadatafs implements a pathfs.FileSystem that exposes the EC2
+// instance metadata service (IMDS) as a filesystem tree.
+package metadatafs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/jszwedko/ec2-metadatafs/internal/logging"
+	"gopkg.in/yaml.v2"
+)
+
+// Names of the synthetic aggregate view files served at the mount root when
+// AggregateViews is enabled. tags.json/tags.yaml are only served once a
+// TagsSource has been set (i.e. once the tags mount is up, see SetTagsSource).
+const (
+	metadataJSONFile = "metadata.json"
+	metadataYAMLFile = "metadata.yaml"
+	tagsJSONFile     = "tags.json"
+	tagsYAMLFile     = "tags.yaml"
+
+	// maxWalkDepth bounds the recursion of the aggregate-view walker so that
+	// a cycle or self-reference in the metadata tree (there is no indication
+	// IMDS can produce one today, but nothing guarantees it can't) can't
+	// recurse forever.
+	maxWalkDepth = 32
+)
+
+func isMetadataAggregateFile(name string) bool {
+	return name == metadataJSONFile || name == metadataYAMLFile
+}
+
+func isTagsAggregateFile(name string) bool {
+	return name == tagsJSONFile || name == tagsYAMLFile
+}
+
+// isServedAggregateFile reports whether name is an aggregate view file this
+// FileSystem currently serves: metadata.json/.yaml are always eligible (once
+// AggregateViews is set), while tags.json/.yaml additionally require a
+// TagsSource to have been installed by the tags mount.
+func (fs *FileSystem) isServedAggregateFile(name string) bool {
+	if isMetadataAggregateFile(name) {
+		return true
+	}
+	if isTagsAggregateFile(name) {
+		_, ok := fs.loadTags()
+		return ok
+	}
+	return false
+}
+
+const (
+	tokenPath      = "latest/api/token"
+	tokenTTL       = 21600 // 6 hours, the maximum allowed by IMDS
+	tokenHeader    = "X-aws-ec2-metadata-token"
+	tokenTTLHdr    = "X-aws-ec2-metadata-token-ttl-seconds"
+	requestTimeout = 5 * time.Second
+)
+
+// Valid values for the IMDSVersion field / --imds-version flag
+const (
+	IMDSv1   = "v1"
+	IMDSv2   = "v2"
+	IMDSAuto = "auto"
+)
+
+// tokenCache holds the IMDSv2 session token, shared by every path lookup
+// (and, via HTTPClient, by the tags mount) so that a token fetched for one
+// lookup is reused by the rest.
+type tokenCache struct {
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+
+	// v2Disabled remembers that IMDSv2 isn't available on this instance
+	// (e.g. the PUT to fetch a token failed or was refused) so that
+	// "auto" mode doesn't retry it on every lookup. Guarded by mu since
+	// lookups run concurrently.
+	v2Disabled bool
+}
+
+func (c *tokenCache) get() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token == "" || time.Now().After(c.expiry) {
+		return ""
+	}
+	return c.token
+}
+
+func (c *tokenCache) set(token string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.token = token
+	// Refresh a little early so we don't race the actual expiry
+	c.expiry = time.Now().Add(ttl - 10*time.Second)
+}
+
+func (c *tokenCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.token = ""
+	c.expiry = time.Time{}
+}
+
+func (c *tokenCache) v2Unavailable() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.v2Disabled
+}
+
+func (c *tokenCache) setV2Unavailable() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.v2Disabled = true
+}
+
+// FileSystem implements pathfs.FileSystem, exposing the EC2 instance
+// metadata service as a filesystem rooted at Endpoint.
+type FileSystem struct {
+	pathfs.FileSystem
+
+	Endpoint    string
+	IMDSVersion string // one of IMDSv1, IMDSv2, or IMDSAuto
+
+	// AggregateViews enables the synthetic metadata.json/metadata.yaml files
+	// at the mount root, each serializing the full metadata tree
+	AggregateViews bool
+
+	logger *logging.Logger
+	client *http.Client
+	tokens *tokenCache
+
+	tagsSourceMu sync.Mutex
+	tagsSource   func() (map[string]string, error)
+}
+
+// SetTagsSource installs the function used to serve tags.json/tags.yaml at
+// the mount root, backed by the live tag map of the tags mount (tagsfs's
+// LoadedTags). It is called once mountTags has set up that mount; until
+// then, tags.json/tags.yaml aren't served even if AggregateViews is set.
+func (fs *FileSystem) SetTagsSource(source func() (map[string]string, error)) {
+	fs.tagsSourceMu.Lock()
+	defer fs.tagsSourceMu.Unlock()
+
+	fs.tagsSource = source
+}
+
+func (fs *FileSystem) loadTags() (func() (map[string]string, error), bool) {
+	fs.tagsSourceMu.Lock()
+	defer fs.tagsSourceMu.Unlock()
+
+	return fs.tagsSource, fs.tagsSource != nil
+}
+
+// New returns a FileSystem that serves the EC2 instance metadata rooted at
+// endpoint. imdsVersion selects whether IMDSv1, IMDSv2, or both ("auto",
+// preferring v2) are used to authenticate requests to the metadata service.
+func New(endpoint string, imdsVersion string, aggregateViews bool, logger *logging.Logger) *FileSystem {
+	if !strings.HasSuffix(endpoint, "/") {
+		endpoint += "/"
+	}
+
+	return &FileSystem{
+		FileSystem:     pathfs.NewDefaultFileSystem(),
+		Endpoint:       endpoint,
+		IMDSVersion:    imdsVersion,
+		AggregateViews: aggregateViews,
+		logger:         logger,
+		client:         &http.Client{Timeout: requestTimeout},
+		tokens:         &tokenCache{},
+	}
+}
+
+// tokenEndpoint returns the scheme+host that the session token should be
+// requested from, derived from Endpoint (which is typically
+// http://169.254.169.254/latest/).
+func (fs *FileSystem) tokenEndpoint() (string, error) {
+	for _, scheme := range []string{"http://", "https://"} {
+		if !strings.HasPrefix(fs.Endpoint, scheme) {
+			continue
+		}
+		if idx := strings.Index(strings.TrimPrefix(fs.Endpoint, scheme), "/"); idx != -1 {
+			return fs.Endpoint[:len(scheme)+idx] + "/" + tokenPath, nil
+		}
+	}
+	return "", fmt.Errorf("unable to derive token endpoint from %q", fs.Endpoint)
+}
+
+// fetchToken requests a new IMDSv2 session token and caches it
+func (fs *FileSystem) fetchToken() (string, error) {
+	tokenURL, err := fs.tokenEndpoint()
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, tokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(tokenTTLHdr, fmt.Sprintf("%d", tokenTTL))
+
+	resp, err := fs.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusForbidden {
+		return "", fmt.Errorf("IMDSv2 token request forbidden (403)")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("IMDSv2 token request failed: %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	fs.tokens.set(string(body), tokenTTL*time.Second)
+	return string(body), nil
+}
+
+// token returns a token to attach to metadata requests, or "" if IMDSv1
+// should be used instead. It honors IMDSVersion: "v1" never fetches a
+// token, "auto" tries v2 and silently falls back to v1 if it isn't
+// available, and "v2" always requires one, returning an error rather than
+// silently falling back if a token can't be fetched.
+func (fs *FileSystem) token() (string, error) {
+	if fs.IMDSVersion == IMDSv1 {
+		return "", nil
+	}
+
+	if token := fs.tokens.get(); token != "" {
+		return token, nil
+	}
+
+	if fs.IMDSVersion == IMDSAuto && fs.tokens.v2Unavailable() {
+		return "", nil
+	}
+
+	token, err := fs.fetchToken()
+	if err != nil {
+		if fs.IMDSVersion == IMDSv2 {
+			return "", fmt.Errorf("failed to fetch required IMDSv2 token: %s", err)
+		}
+		fs.logger.Debugf("IMDSv2 unavailable, falling back to IMDSv1: %s", err)
+		fs.tokens.setV2Unavailable()
+		return "", nil
+	}
+
+	return token, nil
+}
+
+// get performs a GET of path (relative to Endpoint), attaching and
+// refreshing the IMDSv2 token as configured.
+func (fs *FileSystem) get(path string) ([]byte, int, error) {
+	url := fs.Endpoint + strings.TrimPrefix(path, "/")
+
+	do := func(token string) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			req.Header.Set(tokenHeader, token)
+		}
+		return fs.client.Do(req)
+	}
+
+	token, err := fs.token()
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := do(token)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized && token != "" {
+		fs.logger.Debugf("IMDSv2 token rejected, refreshing")
+		fs.tokens.clear()
+		token, err = fs.token()
+		if err != nil {
+			return nil, 0, err
+		}
+		resp, err = do(token)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer resp.Body.Close()
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+
+	return body, resp.StatusCode, nil
+}
+
+// HTTPClient returns an *http.Client whose requests are transparently
+// authenticated with the same IMDSv2 token cache used for path lookups, for
+// use by callers (e.g. the tags mount) that talk to IMDS directly via the
+// AWS SDK's ec2metadata client.
+func (fs *FileSystem) HTTPClient() *http.Client {
+	return &http.Client{
+		Timeout:   requestTimeout,
+		Transport: &tokenRoundTripper{fs: fs, next: http.DefaultTransport},
+	}
+}
+
+// tokenRoundTripper attaches the IMDSv2 token (if any) to every request and
+// retries once with a fresh token on a 401.
+type tokenRoundTripper struct {
+	fs   *FileSystem
+	next http.RoundTripper
+}
+
+func (t *tokenRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.fs.token()
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set(tokenHeader, token)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || token == "" {
+		return resp, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	t.fs.tokens.clear()
+	if token, err = t.fs.token(); err != nil {
+		return nil, err
+	} else if token != "" {
+		req.Header.Set(tokenHeader, token)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// GetAttr implements pathfs.FileSystem
+func (fs *FileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	now := time.Now()
+
+	if name == "" || strings.HasSuffix(name, "/") {
+		return &fuse.Attr{Mode: fuse.S_IFDIR | 0555, Mtime: uint64(now.Unix())}, fuse.OK
+	}
+
+	if fs.AggregateViews && fs.isServedAggregateFile(name) {
+		body, err := fs.renderAggregate(name)
+		if err != nil {
+			fs.logger.Warningf("failed to render %q: %s", name, err)
+			return nil, fuse.EIO
+		}
+		return &fuse.Attr{Mode: fuse.S_IFREG | 0444, Size: uint64(len(body)), Mtime: uint64(now.Unix())}, fuse.OK
+	}
+
+	body, status, err := fs.get(name)
+	if err != nil {
+		fs.logger.Warningf("failed to GetAttr %q: %s", name, err)
+		return nil, fuse.EIO
+	}
+	if status == http.StatusNotFound {
+		return nil, fuse.ENOENT
+	}
+	if status != http.StatusOK {
+		return nil, fuse.EIO
+	}
+
+	if looksLikeDirListing(name, body) {
+		return &fuse.Attr{Mode: fuse.S_IFDIR | 0555, Mtime: uint64(now.Unix())}, fuse.OK
+	}
+
+	return &fuse.Attr{
+		Mode:  fuse.S_IFREG | 0444,
+		Size:  uint64(len(body)),
+		Mtime: uint64(now.Unix()),
+	}, fuse.OK
+}
+
+// looksLikeDirListing guesses whether the body of a GET represents a
+// directory listing (newline separated child names) as opposed to a leaf
+// value. IMDS doesn't otherwise distinguish the two for paths that don't
+// already end in "/", which is ambiguous for a directory with exactly one
+// child: public-keys/<index> is always such a directory (its only entry is
+// "openssh-key"), so it's special cased rather than relying on the body
+// containing a newline.
+func looksLikeDirListing(name string, body []byte) bool {
+	if strings.HasSuffix(name, "/") {
+		return true
+	}
+	if isPublicKeyIndex(name) {
+		return true
+	}
+	return strings.Contains(string(body), "\n")
+}
+
+// isPublicKeyIndex reports whether name is a public-keys/<index> path, e.g.
+// "public-keys/0"
+func isPublicKeyIndex(name string) bool {
+	parts := strings.Split(name, "/")
+	if len(parts) != 2 || parts[0] != "public-keys" {
+		return false
+	}
+	for _, r := range parts[1] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return parts[1] != ""
+}
+
+// listingEntry is a single child of a directory listing, as parsed by
+// parseListing
+type listingEntry struct {
+	name  string
+	isDir bool
+}
+
+// parseListing parses the newline separated body IMDS returns for a
+// directory GET into its child entries
+func parseListing(body []byte) []listingEntry {
+	var entries []listingEntry
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		isDir := false
+		entryName := line
+		if strings.HasSuffix(line, "/") {
+			isDir = true
+			entryName = strings.TrimSuffix(line, "/")
+		} else if idx := strings.Index(line, "="); idx != -1 {
+			// e.g. public-keys/ listings are of the form "0=my-key-name": the
+			// navigable path is the index ("0"), a directory containing
+			// openssh-key etc., not the key name after the "="
+			isDir = true
+			entryName = line[:idx]
+		}
+
+		entries = append(entries, listingEntry{name: entryName, isDir: isDir})
+	}
+	return entries
+}
+
+// OpenDir implements pathfs.FileSystem
+func (fs *FileSystem) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	path := name
+	if path != "" && !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+
+	body, status, err := fs.get(path)
+	if err != nil {
+		fs.logger.Warningf("failed to OpenDir %q: %s", name, err)
+		return nil, fuse.EIO
+	}
+	if status == http.StatusNotFound {
+		return nil, fuse.ENOENT
+	}
+	if status != http.StatusOK {
+		return nil, fuse.EIO
+	}
+
+	listing := parseListing(body)
+	entries := make([]fuse.DirEntry, 0, len(listing)+2)
+	for _, e := range listing {
+		mode := uint32(fuse.S_IFREG)
+		if e.isDir {
+			mode = fuse.S_IFDIR
+		}
+		entries = append(entries, fuse.DirEntry{Name: e.name, Mode: mode})
+	}
+
+	if name == "" && fs.AggregateViews {
+		entries = append(entries,
+			fuse.DirEntry{Name: metadataJSONFile, Mode: fuse.S_IFREG},
+			fuse.DirEntry{Name: metadataYAMLFile, Mode: fuse.S_IFREG})
+		if _, ok := fs.loadTags(); ok {
+			entries = append(entries,
+				fuse.DirEntry{Name: tagsJSONFile, Mode: fuse.S_IFREG},
+				fuse.DirEntry{Name: tagsYAMLFile, Mode: fuse.S_IFREG})
+		}
+	}
+
+	return entries, fuse.OK
+}
+
+// Open implements pathfs.FileSystem
+func (fs *FileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EROFS
+	}
+
+	if fs.AggregateViews && fs.isServedAggregateFile(name) {
+		body, err := fs.renderAggregate(name)
+		if err != nil {
+			fs.logger.Warningf("failed to render %q: %s", name, err)
+			return nil, fuse.EIO
+		}
+		return nodefs.NewDataFile(body), fuse.OK
+	}
+
+	body, status, err := fs.get(name)
+	if err != nil {
+		fs.logger.Warningf("failed to Open %q: %s", name, err)
+		return nil, fuse.EIO
+	}
+	if status == http.StatusNotFound {
+		return nil, fuse.ENOENT
+	}
+	if status != http.StatusOK {
+		return nil, fuse.EIO
+	}
+
+	return nodefs.NewDataFile(body), fuse.OK
+}
+
+// walk recursively materializes the metadata tree rooted at path into a
+// map[string]interface{} (directories) / string (leaves), bailing out at
+// maxWalkDepth to bound any cycle or self-reference in the tree.
+func (fs *FileSystem) walk(path string, depth int) (interface{}, error) {
+	if depth > maxWalkDepth {
+		fs.logger.Warningf("metadata tree exceeded max depth %d at %q, truncating", maxWalkDepth, path)
+		return nil, nil
+	}
+
+	body, status, err := fs.get(path)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", path, http.StatusText(status))
+	}
+
+	if !looksLikeDirListing(path, body) {
+		return string(body), nil
+	}
+
+	result := map[string]interface{}{}
+	for _, e := range parseListing(body) {
+		childPath := strings.TrimSuffix(path, "/") + "/" + e.name
+		if path == "" {
+			childPath = e.name
+		}
+		if e.isDir {
+			childPath += "/"
+		}
+
+		value, err := fs.walk(childPath, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		result[e.name] = value
+	}
+
+	return result, nil
+}
+
+// renderAggregate builds the full metadata tree, or (for tags.json/
+// tags.yaml) the full tag map via TagsSource, and serializes it as JSON or
+// YAML per the extension of name.
+func (fs *FileSystem) renderAggregate(name string) ([]byte, error) {
+	var tree interface{}
+
+	if isTagsAggregateFile(name) {
+		source, ok := fs.loadTags()
+		if !ok {
+			return nil, fmt.Errorf("%s is not yet available: tags mount isn't up", name)
+		}
+		tags, err := source()
+		if err != nil {
+			return nil, err
+		}
+		tree = tags
+	} else {
+		walked, err := fs.walk("", 0)
+		if err != nil {
+			return nil, err
+		}
+		tree = walked
+	}
+
+	if name == metadataYAMLFile || name == tagsYAMLFile {
+		return yaml.Marshal(tree)
+	}
+	return json.MarshalIndent(tree, "", "  ")
+}
@@ -0,0 +1,212 @@
+package metadatafs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/jszwedko/ec2-metadatafs/internal/logging"
+)
+
+func TestParseListing(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []listingEntry
+	}{
+		{
+			name: "plain directory listing",
+			body: "hostname\nami-id\nplacement/\n",
+			want: []listingEntry{
+				{name: "hostname"},
+				{name: "ami-id"},
+				{name: "placement", isDir: true},
+			},
+		},
+		{
+			name: "public-keys index=name listing",
+			body: "0=my-key-name\n",
+			want: []listingEntry{
+				{name: "0", isDir: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseListing([]byte(tt.body))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseListing(%q) = %+v, want %+v", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsPublicKeyIndex(t *testing.T) {
+	tests := map[string]bool{
+		"public-keys/0":         true,
+		"public-keys/12":        true,
+		"public-keys/0/":        false,
+		"public-keys/0/ssh-key": false,
+		"public-keys":           false,
+		"placement/0":           false,
+	}
+
+	for name, want := range tests {
+		if got := isPublicKeyIndex(name); got != want {
+			t.Errorf("isPublicKeyIndex(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestTokenEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     string
+		wantErr  bool
+	}{
+		{endpoint: "http://169.254.169.254/latest/", want: "http://169.254.169.254/" + tokenPath},
+		{endpoint: "https://example.com/latest/", want: "https://example.com/" + tokenPath},
+		{endpoint: "foo", wantErr: true},
+		{endpoint: "ftp://example.com/latest/", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		fs := New(tt.endpoint, IMDSAuto, false, logging.NewLogger())
+		got, err := fs.tokenEndpoint()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("tokenEndpoint(%q) = %q, want error", tt.endpoint, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("tokenEndpoint(%q) returned unexpected error: %s", tt.endpoint, err)
+		}
+		if got != tt.want {
+			t.Errorf("tokenEndpoint(%q) = %q, want %q", tt.endpoint, got, tt.want)
+		}
+	}
+}
+
+// TestTokenForcedV2Fails ensures that, unlike "auto", IMDSVersion "v2"
+// surfaces a hard error instead of silently falling back to v1 when the
+// token PUT fails.
+func TestTokenForcedV2Fails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && r.URL.Path == "/"+tokenPath {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	fs := New(server.URL+"/latest/", IMDSv2, false, logging.NewLogger())
+	if _, _, err := fs.get("instance-id"); err == nil {
+		t.Fatal("expected get() to fail when IMDSv2 is forced and the token PUT is refused")
+	}
+
+	fsAuto := New(server.URL+"/latest/", IMDSAuto, false, logging.NewLogger())
+	body, status, err := fsAuto.get("instance-id")
+	if err != nil || status != http.StatusOK || string(body) != "ok" {
+		t.Fatalf("expected auto mode to fall back to IMDSv1, got body=%q status=%d err=%v", body, status, err)
+	}
+}
+
+// TestRenderAggregatePublicKeys is a regression test for the walker
+// previously 404ing on a public-keys/<index> subtree (whose navigable path
+// is the index, not the key name after "=").
+func TestRenderAggregatePublicKeys(t *testing.T) {
+	tree := map[string]string{
+		"/latest/":                          "hostname\npublic-keys/\n",
+		"/latest/hostname":                  "my-host",
+		"/latest/public-keys/":              "0=my-key-name\n",
+		"/latest/public-keys/0":             "openssh-key",
+		"/latest/public-keys/0/":            "openssh-key",
+		"/latest/public-keys/0/openssh-key": "ssh-rsa AAAA...",
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := tree[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	fs := New(server.URL+"/latest/", IMDSv1, true, logging.NewLogger())
+
+	raw, err := fs.renderAggregate(metadataJSONFile)
+	if err != nil {
+		t.Fatalf("renderAggregate failed: %s", err)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatalf("failed to unmarshal rendered metadata: %s", err)
+	}
+
+	publicKeys, ok := got["public-keys"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected public-keys to render as an object, got %#v", got["public-keys"])
+	}
+	key0, ok := publicKeys["0"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected public-keys.0 to render as an object, got %#v", publicKeys["0"])
+	}
+	if key0["openssh-key"] != "ssh-rsa AAAA..." {
+		t.Errorf("public-keys.0.openssh-key = %#v, want %q", key0["openssh-key"], "ssh-rsa AAAA...")
+	}
+
+	attr, status := fs.GetAttr("public-keys/0", nil)
+	if status != fuse.OK {
+		t.Fatalf("GetAttr(public-keys/0) = %v, want OK", status)
+	}
+	if attr.Mode&fuse.S_IFDIR == 0 {
+		t.Errorf("GetAttr(public-keys/0).Mode = %v, want a directory", attr.Mode)
+	}
+}
+
+// TestTagsAggregateAtRoot verifies that tags.json/tags.yaml are only served
+// at the metadatafs root once a TagsSource has been installed (i.e. once the
+// tags mount has come up), matching the documented mount-root behavior.
+func TestTagsAggregateAtRoot(t *testing.T) {
+	fs := New("http://169.254.169.254/latest/", IMDSv1, true, logging.NewLogger())
+
+	if _, status := fs.Open(tagsJSONFile, 0, nil); status == fuse.OK {
+		t.Fatal("expected tags.json to be unavailable before SetTagsSource is called")
+	}
+
+	fs.SetTagsSource(func() (map[string]string, error) {
+		return map[string]string{"Name": "my-instance"}, nil
+	})
+
+	file, status := fs.Open(tagsJSONFile, 0, nil)
+	if status != fuse.OK {
+		t.Fatalf("Open(tags.json) = %v, want OK", status)
+	}
+
+	buf := make([]byte, 4096)
+	res, status := file.Read(buf, 0)
+	if status != fuse.OK {
+		t.Fatalf("Read(tags.json) = %v, want OK", status)
+	}
+	data, status := res.Bytes(buf)
+	if status != fuse.OK {
+		t.Fatalf("ReadResult.Bytes() = %v, want OK", status)
+	}
+
+	var got map[string]string
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("failed to unmarshal tags.json: %s", err)
+	}
+	if got["Name"] != "my-instance" {
+		t.Errorf("tags.json = %#v, want Name=my-instance", got)
+	}
+}
@@ -0,0 +1,125 @@
+package tagsfs
+
+import (
+	"sync"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// tagFile is a nodefs.File backing a writable tag. Writes are buffered in
+// memory per-handle and only sent to EC2 (via CreateTags) on Flush/Release,
+// matching how most kernel write-back caches batch small writes into one
+// syscall's worth of I/O.
+type tagFile struct {
+	nodefs.File
+
+	fs   *FileSystem
+	name string
+
+	mu    sync.Mutex
+	buf   []byte
+	dirty bool
+}
+
+func newTagFile(fs *FileSystem, name string, initial []byte) nodefs.File {
+	return &tagFile{
+		File: nodefs.NewDefaultFile(),
+		fs:   fs,
+		name: name,
+		buf:  append([]byte(nil), initial...),
+	}
+}
+
+// Read implements nodefs.File
+func (f *tagFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if off >= int64(len(f.buf)) {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+
+	end := off + int64(len(dest))
+	if end > int64(len(f.buf)) {
+		end = int64(len(f.buf))
+	}
+
+	return fuse.ReadResultData(f.buf[off:end]), fuse.OK
+}
+
+// Write implements nodefs.File, buffering the write in memory
+func (f *tagFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	end := off + int64(len(data))
+	if end > int64(len(f.buf)) {
+		grown := make([]byte, end)
+		copy(grown, f.buf)
+		f.buf = grown
+	}
+	copy(f.buf[off:end], data)
+	f.dirty = true
+
+	return uint32(len(data)), fuse.OK
+}
+
+// Truncate implements nodefs.File, resizing the in-memory buffer
+func (f *tagFile) Truncate(size uint64) fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case uint64(len(f.buf)) == size:
+	case uint64(len(f.buf)) > size:
+		f.buf = f.buf[:size]
+	default:
+		grown := make([]byte, size)
+		copy(grown, f.buf)
+		f.buf = grown
+	}
+	f.dirty = true
+
+	return fuse.OK
+}
+
+// GetAttr implements nodefs.File
+func (f *tagFile) GetAttr(out *fuse.Attr) fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out.Mode = fuse.S_IFREG | 0644
+	out.Size = uint64(len(f.buf))
+	return fuse.OK
+}
+
+// flush sends the buffered value to EC2, if it has changed since the last
+// flush. Called from both Flush and Release since either may be the only
+// one invoked depending on the calling process.
+func (f *tagFile) flush() fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.dirty {
+		return fuse.OK
+	}
+
+	if err := f.fs.createTag(f.name, string(f.buf)); err != nil {
+		f.fs.logger.Warningf("failed to flush tag %q: %s", f.name, err)
+		return fuse.EIO
+	}
+
+	f.dirty = false
+	return fuse.OK
+}
+
+// Flush implements nodefs.File
+func (f *tagFile) Flush() fuse.Status {
+	return f.flush()
+}
+
+// Release implements nodefs.File
+func (f *tagFile) Release() {
+	f.flush()
+}
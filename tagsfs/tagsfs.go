@@ -0,0 +1,346 @@
+// Package tagsfs implements a pathfs.FileSystem that exposes the EC2 tags of
+// a single instance as a flat directory of files, one per tag key. Unless
+// ReadOnly is set, the tree is writable: writing a file invokes CreateTags,
+// removing one invokes DeleteTags, and creating one adds an empty tag.
+package tagsfs
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/jszwedko/ec2-metadatafs/internal/logging"
+)
+
+// FileSystem implements pathfs.FileSystem, exposing the tags of instanceID
+// as files named after each tag key.
+type FileSystem struct {
+	pathfs.FileSystem
+
+	svc        ec2iface.EC2API
+	instanceID string
+	logger     *logging.Logger
+
+	// CacheSec controls how long the tag map is cached before being
+	// re-fetched from the EC2 API: 0 disables caching, -1 caches
+	// indefinitely, and any positive value is a number of seconds. It
+	// mirrors the --cachesec flag.
+	CacheSec int
+
+	// ReadOnly disables CreateTags/DeleteTags, preserving the original
+	// read-only behavior of this filesystem.
+	ReadOnly bool
+
+	mu        sync.Mutex
+	tags      map[string]string
+	fetchedAt time.Time
+}
+
+// New returns a FileSystem exposing the tags of instanceID, fetched via svc.
+func New(svc ec2iface.EC2API, instanceID string, logger *logging.Logger, cacheSec int, readOnly bool) *FileSystem {
+	return &FileSystem{
+		FileSystem: pathfs.NewDefaultFileSystem(),
+		svc:        svc,
+		instanceID: instanceID,
+		logger:     logger,
+		CacheSec:   cacheSec,
+		ReadOnly:   readOnly,
+	}
+}
+
+// LoadedTags returns the cached tag map, fetching it if it is missing or
+// stale. It is exported so that the root metadatafs tree can use it as the
+// source for its tags.json/tags.yaml aggregate views once this filesystem
+// has been mounted.
+func (fs *FileSystem) LoadedTags() (map[string]string, error) {
+	return fs.loadedTags()
+}
+
+// fetchTags retrieves the current tags for the instance from the EC2 API
+func (fs *FileSystem) fetchTags() (map[string]string, error) {
+	out, err := fs.svc.DescribeTags(&ec2.DescribeTagsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("resource-id"), Values: []*string{aws.String(fs.instanceID)}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string, len(out.Tags))
+	for _, tag := range out.Tags {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+
+	return tags, nil
+}
+
+// stale reports whether the cached tag map needs to be refreshed, per
+// CacheSec semantics (0 disables caching, -1 caches indefinitely)
+func (fs *FileSystem) stale() bool {
+	if fs.tags == nil {
+		return true
+	}
+	if fs.CacheSec < 0 {
+		return false
+	}
+	if fs.CacheSec == 0 {
+		return true
+	}
+	return time.Since(fs.fetchedAt) > time.Duration(fs.CacheSec)*time.Second
+}
+
+// loadedTags returns the cached tag map, fetching it if it is missing or
+// stale
+func (fs *FileSystem) loadedTags() (map[string]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !fs.stale() {
+		return fs.tags, nil
+	}
+
+	tags, err := fs.fetchTags()
+	if err != nil {
+		return nil, err
+	}
+
+	fs.tags = tags
+	fs.fetchedAt = time.Now()
+	return tags, nil
+}
+
+// cacheSet records key=value in the cached tag map and resets the cache's
+// freshness, so that the change is visible to a read immediately instead of
+// waiting for CacheSec to elapse. It copies fs.tags rather than mutating it
+// in place, since readers call loadedTags, take a reference to the map, and
+// then range/index it after releasing fs.mu; mutating the existing map out
+// from under such a reader would be a data race.
+func (fs *FileSystem) cacheSet(key, value string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	tags := make(map[string]string, len(fs.tags)+1)
+	for k, v := range fs.tags {
+		tags[k] = v
+	}
+	tags[key] = value
+
+	fs.tags = tags
+	fs.fetchedAt = time.Now()
+}
+
+// cacheRemove removes key from the cached tag map and resets the cache's
+// freshness, for the same copy-and-swap reason as cacheSet.
+func (fs *FileSystem) cacheRemove(key string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	tags := make(map[string]string, len(fs.tags))
+	for k, v := range fs.tags {
+		if k != key {
+			tags[k] = v
+		}
+	}
+
+	fs.tags = tags
+	fs.fetchedAt = time.Now()
+}
+
+// createTag writes key=value via the EC2 API and updates the cache
+func (fs *FileSystem) createTag(key, value string) error {
+	_, err := fs.svc.CreateTags(&ec2.CreateTagsInput{
+		Resources: []*string{aws.String(fs.instanceID)},
+		Tags:      []*ec2.Tag{{Key: aws.String(key), Value: aws.String(value)}},
+	})
+	if err != nil {
+		return err
+	}
+
+	fs.cacheSet(key, value)
+	return nil
+}
+
+// deleteTag removes key via the EC2 API and updates the cache
+func (fs *FileSystem) deleteTag(key string) error {
+	_, err := fs.svc.DeleteTags(&ec2.DeleteTagsInput{
+		Resources: []*string{aws.String(fs.instanceID)},
+		Tags:      []*ec2.Tag{{Key: aws.String(key)}},
+	})
+	if err != nil {
+		return err
+	}
+
+	fs.cacheRemove(key)
+	return nil
+}
+
+// GetAttr implements pathfs.FileSystem
+func (fs *FileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	now := uint64(time.Now().Unix())
+
+	if name == "" {
+		return &fuse.Attr{Mode: fuse.S_IFDIR | 0555, Mtime: now}, fuse.OK
+	}
+
+	tags, err := fs.loadedTags()
+	if err != nil {
+		fs.logger.Warningf("failed to fetch tags: %s", err)
+		return nil, fuse.EIO
+	}
+
+	value, ok := tags[name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+
+	mode := uint32(fuse.S_IFREG | 0444)
+	if !fs.ReadOnly {
+		mode = fuse.S_IFREG | 0644
+	}
+
+	return &fuse.Attr{Mode: mode, Size: uint64(len(value)), Mtime: now}, fuse.OK
+}
+
+// OpenDir implements pathfs.FileSystem
+func (fs *FileSystem) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if name != "" {
+		return nil, fuse.ENOENT
+	}
+
+	tags, err := fs.loadedTags()
+	if err != nil {
+		fs.logger.Warningf("failed to fetch tags: %s", err)
+		return nil, fuse.EIO
+	}
+
+	entries := make([]fuse.DirEntry, 0, len(tags))
+	for key := range tags {
+		entries = append(entries, fuse.DirEntry{Name: key, Mode: fuse.S_IFREG})
+	}
+
+	return entries, fuse.OK
+}
+
+// Open implements pathfs.FileSystem
+func (fs *FileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	tags, err := fs.loadedTags()
+	if err != nil {
+		fs.logger.Warningf("failed to fetch tags: %s", err)
+		return nil, fuse.EIO
+	}
+
+	value, ok := tags[name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+
+	if flags&fuse.O_ANYWRITE == 0 {
+		return nodefs.NewDataFile([]byte(value)), fuse.OK
+	}
+
+	if fs.ReadOnly {
+		return nil, fuse.EROFS
+	}
+
+	if int(flags)&syscall.O_TRUNC != 0 {
+		value = ""
+	}
+
+	return newTagFile(fs, name, []byte(value)), fuse.OK
+}
+
+// Create implements pathfs.FileSystem, creating an empty tag (like `touch`)
+func (fs *FileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if fs.ReadOnly {
+		return nil, fuse.EROFS
+	}
+
+	if err := fs.createTag(name, ""); err != nil {
+		fs.logger.Warningf("failed to create tag %q: %s", name, err)
+		return nil, fuse.EIO
+	}
+
+	return newTagFile(fs, name, nil), fuse.OK
+}
+
+// Unlink implements pathfs.FileSystem, deleting the tag via DeleteTags
+func (fs *FileSystem) Unlink(name string, context *fuse.Context) fuse.Status {
+	if fs.ReadOnly {
+		return fuse.EROFS
+	}
+
+	tags, err := fs.loadedTags()
+	if err != nil {
+		fs.logger.Warningf("failed to fetch tags: %s", err)
+		return fuse.EIO
+	}
+
+	if _, ok := tags[name]; !ok {
+		return fuse.ENOENT
+	}
+
+	if err := fs.deleteTag(name); err != nil {
+		fs.logger.Warningf("failed to delete tag %q: %s", name, err)
+		return fuse.EIO
+	}
+
+	return fuse.OK
+}
+
+// Truncate implements pathfs.FileSystem, truncating (and, for a truncation
+// to 0, effectively clearing) a tag's value that is not currently open
+func (fs *FileSystem) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	if fs.ReadOnly {
+		return fuse.EROFS
+	}
+
+	tags, err := fs.loadedTags()
+	if err != nil {
+		fs.logger.Warningf("failed to fetch tags: %s", err)
+		return fuse.EIO
+	}
+
+	value, ok := tags[name]
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	if uint64(len(value)) > size {
+		value = value[:size]
+	}
+
+	if err := fs.createTag(name, value); err != nil {
+		fs.logger.Warningf("failed to truncate tag %q: %s", name, err)
+		return fuse.EIO
+	}
+
+	return fuse.OK
+}
+
+// Utimens implements pathfs.FileSystem. EC2 tags don't carry timestamps, so
+// this is a no-op that reports success, which is required for tools like
+// `touch` to succeed against an existing tag.
+func (fs *FileSystem) Utimens(name string, aTime *time.Time, mTime *time.Time, context *fuse.Context) fuse.Status {
+	if fs.ReadOnly {
+		return fuse.EROFS
+	}
+
+	tags, err := fs.loadedTags()
+	if err != nil {
+		fs.logger.Warningf("failed to fetch tags: %s", err)
+		return fuse.EIO
+	}
+
+	if _, ok := tags[name]; !ok {
+		return fuse.ENOENT
+	}
+
+	return fuse.OK
+}
@@ -0,0 +1,95 @@
+package tagsfs
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/jszwedko/ec2-metadatafs/internal/logging"
+)
+
+// fakeEC2 is a minimal ec2iface.EC2API backed by an in-memory tag map, just
+// enough to exercise FileSystem's CreateTags/DeleteTags/DescribeTags calls.
+type fakeEC2 struct {
+	ec2iface.EC2API
+
+	tags map[string]string
+}
+
+func (f *fakeEC2) DescribeTags(in *ec2.DescribeTagsInput) (*ec2.DescribeTagsOutput, error) {
+	out := &ec2.DescribeTagsOutput{}
+	for k, v := range f.tags {
+		out.Tags = append(out.Tags, &ec2.TagDescription{Key: aws.String(k), Value: aws.String(v)})
+	}
+	return out, nil
+}
+
+func (f *fakeEC2) CreateTags(in *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	for _, tag := range in.Tags {
+		f.tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (f *fakeEC2) DeleteTags(in *ec2.DeleteTagsInput) (*ec2.DeleteTagsOutput, error) {
+	for _, tag := range in.Tags {
+		delete(f.tags, aws.StringValue(tag.Key))
+	}
+	return &ec2.DeleteTagsOutput{}, nil
+}
+
+// TestWriteThenReadBackInvalidatesCache verifies that, with caching enabled,
+// a write is visible to an immediate re-read instead of waiting for
+// CacheSec to elapse.
+func TestWriteThenReadBackInvalidatesCache(t *testing.T) {
+	svc := &fakeEC2{tags: map[string]string{"Name": "old-value"}}
+	fs := New(svc, "i-0123456789abcdef0", logging.NewLogger(), -1, false)
+
+	// Prime the cache with the pre-write value.
+	if _, err := fs.loadedTags(); err != nil {
+		t.Fatalf("loadedTags failed: %s", err)
+	}
+
+	file, status := fs.Open("Name", 2 /* O_RDWR */, nil)
+	if status != fuse.OK {
+		t.Fatalf("Open(Name) = %v, want OK", status)
+	}
+	if n, status := file.Write([]byte("new-value"), 0); status != fuse.OK || n != 9 {
+		t.Fatalf("Write = (%d, %v), want (9, OK)", n, status)
+	}
+	if status := file.Flush(); status != fuse.OK {
+		t.Fatalf("Flush = %v, want OK", status)
+	}
+
+	tags, err := fs.loadedTags()
+	if err != nil {
+		t.Fatalf("loadedTags failed: %s", err)
+	}
+	if tags["Name"] != "new-value" {
+		t.Errorf("tags[Name] = %q after write+flush, want %q", tags["Name"], "new-value")
+	}
+	if svc.tags["Name"] != "new-value" {
+		t.Errorf("svc.tags[Name] = %q, want %q (CreateTags not called)", svc.tags["Name"], "new-value")
+	}
+}
+
+// TestUnlinkInvalidatesCache verifies a DeleteTags is reflected immediately
+// in the cached tag map.
+func TestUnlinkInvalidatesCache(t *testing.T) {
+	svc := &fakeEC2{tags: map[string]string{"Owner": "alice"}}
+	fs := New(svc, "i-0123456789abcdef0", logging.NewLogger(), -1, false)
+
+	if status := fs.Unlink("Owner", nil); status != fuse.OK {
+		t.Fatalf("Unlink(Owner) = %v, want OK", status)
+	}
+
+	tags, err := fs.loadedTags()
+	if err != nil {
+		t.Fatalf("loadedTags failed: %s", err)
+	}
+	if _, ok := tags["Owner"]; ok {
+		t.Errorf("tags still contains Owner after Unlink")
+	}
+}